@@ -0,0 +1,72 @@
+package main
+
+import "sync"
+
+// asyncSinkQueueSize bounds an asyncSink's backlog before Write starts
+// returning ErrQueueFull.
+const asyncSinkQueueSize = 256
+
+// asyncSink wraps a Sink so Write enqueues onto a single background
+// goroutine and returns immediately, instead of blocking the request
+// goroutine on the wrapped sink's I/O (e.g. a Kafka produce call). This
+// gives non-file sinks the same enqueue/202/503 behavior writerPool
+// already gives the file sink.
+type asyncSink struct {
+	inner Sink
+	queue chan writeJob
+	wg    sync.WaitGroup
+
+	// See writerPool's identical fields for why Close needs this lock
+	// instead of just closing queue.
+	closedMu sync.RWMutex
+	closed   bool
+}
+
+func newAsyncSink(inner Sink) *asyncSink {
+	a := &asyncSink{inner: inner, queue: make(chan writeJob, asyncSinkQueueSize)}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+func (a *asyncSink) run() {
+	defer a.wg.Done()
+	for job := range a.queue {
+		if err := a.inner.Write(job.logger, job.samples); err != nil {
+			job.logger.Printf("async sink: %s", err)
+		}
+	}
+}
+
+func (a *asyncSink) Write(logger *reqLogger, samples []*Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	a.closedMu.RLock()
+	defer a.closedMu.RUnlock()
+	if a.closed {
+		return ErrQueueFull
+	}
+
+	select {
+	case a.queue <- writeJob{logger: logger, samples: samples}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (a *asyncSink) Close() error {
+	a.closedMu.Lock()
+	if a.closed {
+		a.closedMu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.closedMu.Unlock()
+
+	close(a.queue)
+	a.wg.Wait()
+	return a.inner.Close()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// Decoder turns a raw device payload into decoded samples. Implementations
+// are registered by URL version so the POST handler can dispatch on the
+// request path without knowing about wire formats.
+type Decoder interface {
+	Decode(body []byte) ([]*Sample, error)
+}
+
+// decoders maps a version string (the first path segment of the data
+// endpoint, e.g. "v0", "v1") to the Decoder that understands its wire
+// format.
+var decoders = map[string]Decoder{
+	"v0": decoderFunc(decodeV0),
+	"v1": decoderFunc(decodeV1),
+}
+
+// decoderFunc adapts a plain decode function to the Decoder interface.
+type decoderFunc func(body []byte) ([]*Sample, error)
+
+func (f decoderFunc) Decode(body []byte) ([]*Sample, error) { return f(body) }
+
+// SensorMeta describes how to turn a raw int16 measurement into a scaled
+// physical value, as declared once in a v1 header.
+type SensorMeta struct {
+	Name   string
+	Unit   string
+	Scale  float32
+	Offset float32
+}
+
+const (
+	v1Magic0 = 'S'
+	v1Magic1 = 'D'
+	v1Version = 1
+
+	v1SensorNameLen = 8
+	v1SensorUnitLen = 4
+)
+
+// maxSamplesPerFrame bounds nsamp, which both v0 and v1 read straight off
+// the wire as a signed int16. Without this check a frame with the high
+// bit set (or any implausibly large count) reaches make([]*Sample, nsamp)
+// and panics with "makeslice: len out of range" before any decode error
+// handling runs.
+const maxSamplesPerFrame = 10000
+
+// Header description. V1
+// TYPE          BYTES   DESCRIPTION
+// byte[2]         2     magic ("SD")
+// byte            1     version (1)
+// char[10]       10     account id
+// char[10]       10     device id
+// u long          4     base unix time in seconds (t1)
+// u long          4     delta time to be added to base time in milliseconds (t2)
+// short           2     sample period in milliseconds
+// short           2     num samples per measurement
+// byte            1     num measurements (num analog sensors)
+// u short         2     payload length in bytes
+// [nmeas] x:            per-sensor metadata, one entry per measurement
+//   char[8]       8       sensor name
+//   char[4]       4       sensor unit
+//   float32       4       scale  (physical = raw*scale + offset)
+//   float32       4       offset
+// [payload]       *     nsamp * nmeas int16 raw values, LittleEndian
+// u long          4     CRC32 (IEEE) over the payload bytes only
+//
+// Unlike v0, the payload length and checksum let the server detect
+// truncated or corrupted frames instead of reading past the buffer.
+func decodeV1(body []byte) (samples []*Sample, err error) {
+	buf := bytes.NewReader(body)
+
+	var magic [2]byte
+	if err = binary.Read(buf, binary.LittleEndian, &magic); err != nil {
+		return nil, ErrShortHeader
+	}
+	if magic[0] != v1Magic0 || magic[1] != v1Magic1 {
+		return nil, fmt.Errorf("decodeV1: bad magic %q", magic)
+	}
+
+	var version byte
+	if err = binary.Read(buf, binary.LittleEndian, &version); err != nil {
+		return nil, ErrShortHeader
+	}
+	if version != v1Version {
+		return nil, fmt.Errorf("decodeV1: unsupported version %d", version)
+	}
+
+	var id, device [10]byte
+	var t1, t2 uint32
+	var per, nsamp int16
+	var nmeas byte
+	var payloadLen uint16
+	for _, v := range []interface{}{&id, &device, &t1, &t2, &per, &nsamp, &nmeas, &payloadLen} {
+		if err = binary.Read(buf, binary.LittleEndian, v); err != nil {
+			return nil, ErrShortHeader
+		}
+	}
+
+	if !validID(id) {
+		return nil, ErrBadAccountID
+	}
+	if !validID(device) {
+		return nil, ErrBadDeviceID
+	}
+	if nsamp < 0 || nsamp > maxSamplesPerFrame {
+		return nil, ErrBadSampleCount
+	}
+
+	sensors := make([]SensorMeta, nmeas)
+	for i := range sensors {
+		var name [v1SensorNameLen]byte
+		var unit [v1SensorUnitLen]byte
+		var scale, offset float32
+		if err = binary.Read(buf, binary.LittleEndian, &name); err != nil {
+			return nil, ErrShortHeader
+		}
+		if err = binary.Read(buf, binary.LittleEndian, &unit); err != nil {
+			return nil, ErrShortHeader
+		}
+		if err = binary.Read(buf, binary.LittleEndian, &scale); err != nil {
+			return nil, ErrShortHeader
+		}
+		if err = binary.Read(buf, binary.LittleEndian, &offset); err != nil {
+			return nil, ErrShortHeader
+		}
+		sensors[i] = SensorMeta{
+			Name:   strings.TrimRight(string(name[:]), "\x00"),
+			Unit:   strings.TrimRight(string(unit[:]), "\x00"),
+			Scale:  scale,
+			Offset: offset,
+		}
+	}
+
+	if int(payloadLen) != int(nsamp)*int(nmeas)*2 {
+		return nil, ErrTruncatedPayload
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err = io.ReadFull(buf, payload); err != nil {
+		return nil, ErrTruncatedPayload
+	}
+
+	var wantCRC uint32
+	if err = binary.Read(buf, binary.LittleEndian, &wantCRC); err != nil {
+		return nil, ErrShortHeader
+	}
+	if gotCRC := crc32.ChecksumIEEE(payload); gotCRC != wantCRC {
+		return nil, ErrBadChecksum
+	}
+
+	pbuf := bytes.NewReader(payload)
+	samples = make([]*Sample, nsamp)
+	var i16 int16
+	for i := int16(0); i < nsamp; i++ {
+		values := make([]int16, nmeas)
+		for j := byte(0); j < nmeas; j++ {
+			if err = binary.Read(pbuf, binary.LittleEndian, &i16); err != nil {
+				return nil, ErrTruncatedPayload
+			}
+			values[j] = i16
+		}
+		samples[i] = &Sample{
+			id:      id,
+			device:  device,
+			time:    time.Unix(int64(t1), (int64(t2)+int64(per)*int64(i))*1000000),
+			per:     per,
+			values:  values,
+			sensors: sensors,
+		}
+	}
+	return samples, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// buildV1Frame assembles a well-formed v1 frame for account/device, with
+// one sensor per column in values and nsamp samples, each column read
+// from values[sampleIndex][sensorIndex].
+func buildV1Frame(t *testing.T, account, device string, t1, t2 uint32, per int16, sensors []SensorMeta, values [][]int16) []byte {
+	t.Helper()
+
+	var id, dev [10]byte
+	copy(id[:], account)
+	copy(dev[:], device)
+
+	nsamp := int16(len(values))
+	nmeas := byte(len(sensors))
+
+	var payload bytes.Buffer
+	for _, row := range values {
+		for _, v := range row {
+			if err := binary.Write(&payload, binary.LittleEndian, v); err != nil {
+				t.Fatalf("building payload: %s", err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(v1Magic0)
+	buf.WriteByte(v1Magic1)
+	buf.WriteByte(v1Version)
+	buf.Write(id[:])
+	buf.Write(dev[:])
+	binary.Write(&buf, binary.LittleEndian, t1)
+	binary.Write(&buf, binary.LittleEndian, t2)
+	binary.Write(&buf, binary.LittleEndian, per)
+	binary.Write(&buf, binary.LittleEndian, nsamp)
+	buf.WriteByte(nmeas)
+	binary.Write(&buf, binary.LittleEndian, uint16(payload.Len()))
+
+	for _, s := range sensors {
+		var name [v1SensorNameLen]byte
+		var unit [v1SensorUnitLen]byte
+		copy(name[:], s.Name)
+		copy(unit[:], s.Unit)
+		buf.Write(name[:])
+		buf.Write(unit[:])
+		binary.Write(&buf, binary.LittleEndian, s.Scale)
+		binary.Write(&buf, binary.LittleEndian, s.Offset)
+	}
+
+	buf.Write(payload.Bytes())
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(payload.Bytes()))
+
+	return buf.Bytes()
+}
+
+func TestDecodeV1RoundTrip(t *testing.T) {
+	sensors := []SensorMeta{
+		{Name: "temp", Unit: "C", Scale: 0.1, Offset: -40},
+		{Name: "humidity", Unit: "pct", Scale: 0.5, Offset: 0},
+	}
+	values := [][]int16{
+		{100, 10},
+		{200, 20},
+	}
+	body := buildV1Frame(t, "ACCOUNT001", "DEVICE0001", 1700000000, 0, 1000, sensors, values)
+
+	samples, err := decodeV1(body)
+	if err != nil {
+		t.Fatalf("decodeV1: unexpected error: %s", err)
+	}
+	if len(samples) != len(values) {
+		t.Fatalf("decodeV1: got %d samples, want %d", len(samples), len(values))
+	}
+	for i, s := range samples {
+		if string(s.id[:]) != "ACCOUNT001" {
+			t.Errorf("sample %d: id = %q", i, s.id)
+		}
+		if string(s.device[:]) != "DEVICE0001" {
+			t.Errorf("sample %d: device = %q", i, s.device)
+		}
+		if len(s.sensors) != len(sensors) {
+			t.Fatalf("sample %d: got %d sensors, want %d", i, len(s.sensors), len(sensors))
+		}
+		for k, v := range values[i] {
+			if s.values[k] != v {
+				t.Errorf("sample %d sensor %d: raw value = %d, want %d", i, k, s.values[k], v)
+			}
+			if s.sensors[k].Name != sensors[k].Name {
+				t.Errorf("sample %d sensor %d: name = %q, want %q", i, k, s.sensors[k].Name, sensors[k].Name)
+			}
+		}
+	}
+}
+
+func TestDecodeV1TruncatedPayload(t *testing.T) {
+	sensors := []SensorMeta{{Name: "temp", Unit: "C", Scale: 1, Offset: 0}}
+	body := buildV1Frame(t, "ACCOUNT001", "DEVICE0001", 1700000000, 0, 1000, sensors, [][]int16{{1}, {2}})
+
+	// Truncate into the payload itself (not just the trailing CRC) so
+	// io.ReadFull comes up short while reading it.
+	truncated := body[:len(body)-6]
+
+	if _, err := decodeV1(truncated); err != ErrTruncatedPayload {
+		t.Fatalf("decodeV1(truncated): got err %v, want ErrTruncatedPayload", err)
+	}
+}
+
+func TestDecodeV1BadChecksum(t *testing.T) {
+	sensors := []SensorMeta{{Name: "temp", Unit: "C", Scale: 1, Offset: 0}}
+	body := buildV1Frame(t, "ACCOUNT001", "DEVICE0001", 1700000000, 0, 1000, sensors, [][]int16{{1}, {2}})
+
+	// Flip a bit in the payload without touching the trailing CRC, so the
+	// length still matches but the checksum no longer does.
+	corrupted := append([]byte(nil), body...)
+	payloadStart := len(corrupted) - 4 /* crc */ - 4 /* two int16 samples */
+	corrupted[payloadStart] ^= 0xff
+
+	if _, err := decodeV1(corrupted); err != ErrBadChecksum {
+		t.Fatalf("decodeV1(corrupted): got err %v, want ErrBadChecksum", err)
+	}
+}
+
+func TestDecodeV1RejectsOversizedSampleCount(t *testing.T) {
+	sensors := []SensorMeta{{Name: "temp", Unit: "C", Scale: 1, Offset: 0}}
+	body := buildV1Frame(t, "ACCOUNT001", "DEVICE0001", 1700000000, 0, 1000, sensors, [][]int16{{1}})
+
+	// nsamp is the two bytes right after the two 10-byte ids, the two
+	// 4-byte timestamps and the 2-byte period, following the 2-byte
+	// magic + 1-byte version.
+	nsampOffset := 2 + 1 + 10 + 10 + 4 + 4 + 2
+	binary.LittleEndian.PutUint16(body[nsampOffset:], 0x8000) // negative as int16
+
+	if _, err := decodeV1(body); err != ErrBadSampleCount {
+		t.Fatalf("decodeV1(negative nsamp): got err %v, want ErrBadSampleCount", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "errors"
+
+// Typed errors returned by the decode and write paths. Keeping them as
+// sentinel values lets the HTTP handler map them to a status code and a
+// stable error code without parsing error strings.
+var (
+	ErrEmptyBody        = errors.New("empty request body")
+	ErrShortHeader      = errors.New("short header")
+	ErrTruncatedPayload = errors.New("truncated payload")
+	ErrBadChecksum      = errors.New("payload failed CRC32 check")
+	ErrBadAccountID     = errors.New("bad account id")
+	ErrBadDeviceID      = errors.New("bad device id")
+	ErrBadSampleCount   = errors.New("invalid sample count")
+	ErrQueueFull        = errors.New("write queue full")
+)
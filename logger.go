@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// requestSeq backs nextRequestID. A process-local incrementing counter is
+// enough to correlate log lines for a single seder instance; it does not
+// need to be globally unique.
+var requestSeq uint64
+
+// nextRequestID returns a new identifier to tag a single HTTP request
+// through decode, write, and any error response.
+func nextRequestID() string {
+	n := atomic.AddUint64(&requestSeq, 1)
+	return fmt.Sprintf("req-%d", n)
+}
+
+// reqLogger decorates the standard logger with the fields that identify
+// the request being handled (request id, and account/device once known),
+// so a device's traffic can be grepped by request id instead of hunting
+// through stack traces.
+type reqLogger struct {
+	requestID string
+	account   string
+	device    string
+}
+
+func newReqLogger(requestID string) *reqLogger {
+	return &reqLogger{requestID: requestID}
+}
+
+// withSample returns a logger carrying the account/device of sample, for
+// use once a payload has been decoded.
+func (l *reqLogger) withSample(sample *Sample) *reqLogger {
+	return &reqLogger{
+		requestID: l.requestID,
+		account:   string(sample.id[:]),
+		device:    string(sample.device[:]),
+	}
+}
+
+func (l *reqLogger) Printf(format string, args ...interface{}) {
+	log.Printf("request_id=%s account=%q device=%q "+format, append([]interface{}{l.requestID, l.account, l.device}, args...)...)
+}
+
+// errorResponse is the JSON envelope returned for any 4xx/5xx response
+// from the data endpoints.
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// writeJSONError writes a structured error envelope and sets the response
+// status code.
+func writeJSONError(res http.ResponseWriter, status int, code, message, requestID string) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	body, err := json.Marshal(errorResponse{Code: code, Message: message, RequestID: requestID})
+	if err != nil {
+		return
+	}
+	res.Write(body)
+}
+
+// decodeErrorCode maps a decode error to the HTTP status and stable error
+// code reported in the JSON error envelope.
+func decodeErrorCode(err error) (status int, code string) {
+	switch err {
+	case ErrShortHeader:
+		return http.StatusBadRequest, "short_header"
+	case ErrTruncatedPayload:
+		return http.StatusBadRequest, "truncated_payload"
+	case ErrBadChecksum:
+		return http.StatusBadRequest, "bad_checksum"
+	case ErrBadAccountID:
+		return http.StatusBadRequest, "bad_account_id"
+	case ErrBadDeviceID:
+		return http.StatusBadRequest, "bad_device_id"
+	case ErrBadSampleCount:
+		return http.StatusBadRequest, "bad_sample_count"
+	default:
+		return http.StatusBadRequest, "decode_error"
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	samplesReceivedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "seder_samples_received_total",
+			Help: "Total number of decoded samples received, by account and device.",
+		},
+		[]string{"account", "device"},
+	)
+
+	bytesReceivedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "seder_bytes_received_total",
+			Help: "Total number of raw bytes received on the data endpoints.",
+		},
+	)
+
+	decodeErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "seder_decode_errors_total",
+			Help: "Total number of payloads that failed to decode, by protocol version and reason.",
+		},
+		[]string{"version", "reason"},
+	)
+
+	writeLatencySeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "seder_write_latency_seconds",
+			Help:    "Latency of writing a decoded batch to the file writer.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	fileOpenErrorsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "seder_file_open_errors_total",
+			Help: "Total number of errors opening or creating a device's data file.",
+		},
+	)
+
+	lastSeenTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "seder_last_seen_timestamp_seconds",
+			Help: "Unix timestamp of the last sample received for a device.",
+		},
+		[]string{"account", "device"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		samplesReceivedTotal,
+		bytesReceivedTotal,
+		decodeErrorsTotal,
+		writeLatencySeconds,
+		fileOpenErrorsTotal,
+		lastSeenTimestamp,
+	)
+}
+
+// metricsHandler serves /metrics for Prometheus to scrape.
+var metricsHandler = promhttp.Handler()
+
+// recordDecodeError increments the decode error counter for a protocol
+// version, reusing the same reason classification the HTTP handler uses
+// to pick a response status code.
+func recordDecodeError(version string, err error) {
+	_, code := decodeErrorCode(err)
+	decodeErrorsTotal.WithLabelValues(version, code).Inc()
+}
+
+// maxTrackedDeviceLabels bounds how many distinct (account, device)
+// label pairs recordSamplesReceived will create series for. Without a
+// cap, devices sending varying ids (malicious or just churning) would
+// grow Prometheus's in-memory label cardinality without bound.
+const maxTrackedDeviceLabels = 1000
+
+var (
+	deviceLabelsMu sync.Mutex
+	deviceLabels   = make(map[string]struct{}, maxTrackedDeviceLabels)
+)
+
+// deviceLabelPair returns the (account, device) label values to use for a
+// sample's per-device metrics. Once maxTrackedDeviceLabels distinct
+// devices have been seen, any new one is folded into a single shared
+// "overflow" series instead of growing cardinality further.
+func deviceLabelPair(account, device string) (string, string) {
+	key := account + "|" + device
+
+	deviceLabelsMu.Lock()
+	defer deviceLabelsMu.Unlock()
+
+	if _, ok := deviceLabels[key]; ok {
+		return account, device
+	}
+	if len(deviceLabels) >= maxTrackedDeviceLabels {
+		return "overflow", "overflow"
+	}
+	deviceLabels[key] = struct{}{}
+	return account, device
+}
+
+// recordSamplesReceived updates the per-device ingest counter and
+// last-seen gauge for a successfully decoded batch.
+func recordSamplesReceived(samples []*Sample) {
+	for _, s := range samples {
+		account, device := deviceLabelPair(string(s.id[:]), string(s.device[:]))
+		samplesReceivedTotal.WithLabelValues(account, device).Inc()
+		lastSeenTimestamp.WithLabelValues(account, device).Set(float64(s.time.Unix()))
+	}
+}
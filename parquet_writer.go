@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetMaxBatchSize forces an early flush of a batch that has not yet
+// reached its hour rollover, so a busy device doesn't grow an unbounded
+// batch in memory.
+const parquetMaxBatchSize = 10000
+
+// parquetFlushInterval controls how often the background flusher checks
+// for batches whose hour has rolled over.
+const parquetFlushInterval = time.Minute
+
+// parquetBatch accumulates samples for a single (account, device, hour)
+// until it is flushed to a Parquet file. seq is this batch's position in
+// the sequence of flushes for its (account, device, hour) key, used to
+// give each flush its own file (see parquetRollup.seqs).
+type parquetBatch struct {
+	account string
+	device  string
+	hour    time.Time
+	seq     int
+	samples []*Sample
+}
+
+// parquetRollup batches samples per (account, device, hour) in memory
+// and flushes each batch to a Parquet file on hour rollover or when it
+// grows past parquetMaxBatchSize. A background goroutine drives the
+// rollover check; Close flushes everything still buffered so a graceful
+// shutdown doesn't lose in-flight batches.
+type parquetRollup struct {
+	dataDir string
+
+	mu      sync.Mutex
+	batches map[string]*parquetBatch
+
+	// seqs counts how many times each (account, device, hour) key has
+	// been flushed. A Parquet file can't be appended to in place, and a
+	// busy device can cross parquetMaxBatchSize more than once within
+	// the same hour, so every flush of a key needs its own file or a
+	// later flush silently overwrites the rows an earlier one wrote.
+	// Entries are one int each and keyed by hour, so this grows at the
+	// same rate as the Parquet files already being written to disk.
+	seqs map[string]int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newParquetRollup(dataDir string) *parquetRollup {
+	r := &parquetRollup{
+		dataDir: dataDir,
+		batches: make(map[string]*parquetBatch),
+		seqs:    make(map[string]int),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// nextSeq returns the next flush sequence number for key and advances it.
+// Callers must hold r.mu.
+func (r *parquetRollup) nextSeq(key string) int {
+	seq := r.seqs[key]
+	r.seqs[key] = seq + 1
+	return seq
+}
+
+func parquetBatchKey(account, device string, hour time.Time) string {
+	return account + "|" + device + "|" + hour.Format("2006010215")
+}
+
+// Add appends samples to their (account, device, hour) batch, flushing
+// any batch that crosses parquetMaxBatchSize immediately.
+func (r *parquetRollup) Add(samples []*Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	var toFlush []*parquetBatch
+
+	r.mu.Lock()
+	for _, s := range samples {
+		account := string(s.id[:])
+		device := string(s.device[:])
+		hour := s.time.UTC().Truncate(time.Hour)
+		key := parquetBatchKey(account, device, hour)
+
+		b, ok := r.batches[key]
+		if !ok {
+			b = &parquetBatch{account: account, device: device, hour: hour}
+			r.batches[key] = b
+		}
+		b.samples = append(b.samples, s)
+		if len(b.samples) >= parquetMaxBatchSize {
+			b.seq = r.nextSeq(key)
+			toFlush = append(toFlush, b)
+			delete(r.batches, key)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, b := range toFlush {
+		if err := r.flushBatch(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run periodically rolls over batches whose hour has passed, so a live
+// device doesn't keep a partial hour pinned in memory forever.
+func (r *parquetRollup) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(parquetFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.flushExpired(time.Now().UTC())
+		case <-r.stop:
+			r.flushAll()
+			return
+		}
+	}
+}
+
+func (r *parquetRollup) flushExpired(now time.Time) {
+	r.mu.Lock()
+	var expired []*parquetBatch
+	for key, b := range r.batches {
+		if now.Sub(b.hour) >= time.Hour {
+			b.seq = r.nextSeq(key)
+			expired = append(expired, b)
+			delete(r.batches, key)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, b := range expired {
+		if err := r.flushBatch(b); err != nil {
+			log.Printf("parquet rollup: %s", err)
+		}
+	}
+}
+
+func (r *parquetRollup) flushAll() {
+	r.mu.Lock()
+	batches := r.batches
+	r.batches = make(map[string]*parquetBatch)
+	for key, b := range batches {
+		b.seq = r.nextSeq(key)
+	}
+	r.mu.Unlock()
+
+	for _, b := range batches {
+		if err := r.flushBatch(b); err != nil {
+			log.Printf("parquet rollup: %s", err)
+		}
+	}
+}
+
+// Close stops the background flusher and flushes any batches still
+// buffered, so a SIGTERM doesn't lose samples that haven't hit a rollover
+// or the size threshold yet.
+func (r *parquetRollup) Close() error {
+	close(r.stop)
+	<-r.done
+	return nil
+}
+
+func (r *parquetRollup) flushBatch(b *parquetBatch) error {
+	if len(b.samples) == 0 {
+		return nil
+	}
+
+	// seq is 0 for the common case of one flush per hour, keeping the
+	// original filename; a second or later flush of the same hour (a busy
+	// device crossing parquetMaxBatchSize more than once, or a late
+	// rollover flush after an early size-triggered one) gets its own file
+	// instead of overwriting the rows the earlier flush already wrote.
+	fn := fmt.Sprintf("%02d-%s.parquet", b.hour.Hour(), b.device)
+	if b.seq > 0 {
+		fn = fmt.Sprintf("%02d-%s.%d.parquet", b.hour.Hour(), b.device, b.seq)
+	}
+	path := filepath.Join(r.dataDir, b.account, b.hour.Format("2006/01/02"), fn)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("parquet rollup: can't create path %s: %s", filepath.Dir(path), err)
+	}
+
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return fmt.Errorf("parquet rollup: can't create file %s: %s", path, err)
+	}
+	defer fw.Close()
+
+	pw, err := writer.NewJSONWriter(parquetSchema(b.samples[0]), fw, 1)
+	if err != nil {
+		return fmt.Errorf("parquet rollup: can't init writer for %s: %s", path, err)
+	}
+
+	for _, s := range b.samples {
+		row, err := parquetRow(s)
+		if err != nil {
+			return fmt.Errorf("parquet rollup: can't encode row: %s", err)
+		}
+		if err := pw.Write(row); err != nil {
+			return fmt.Errorf("parquet rollup: can't write row to %s: %s", path, err)
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		return fmt.Errorf("parquet rollup: can't finalize %s: %s", path, err)
+	}
+	return nil
+}
+
+// parquetColumnName sanitizes a Sample.header() column name (which for
+// v1 samples comes from a device-declared sensor name) into a safe
+// Parquet/JSON field name: only [A-Za-z0-9_], anything else becomes '_'.
+func parquetColumnName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// parquetSchema builds the xitongsys/parquet-go JSON schema for a batch,
+// derived from sample.header() so the Parquet rollup and the CSV writer
+// agree on columns and on raw vs. scaled values for the same samples
+// (Parquet column names are header() names passed through
+// parquetColumnName, so they differ where a name has other bytes): v0
+// samples (no sensor metadata) get one INT16 column per analog sensor,
+// v1 samples (scaled via measurement()) get DOUBLE columns instead of
+// raw ints. Account and device are dictionary-encoded since a file only
+// ever covers one of each.
+func parquetSchema(sample *Sample) string {
+	fields := []string{
+		`{"Tag": "name=account, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"}`,
+		`{"Tag": "name=device, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"}`,
+		`{"Tag": "name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"}`,
+		`{"Tag": "name=period, type=INT32, convertedtype=INT_16"}`,
+	}
+	names := sample.header()[4:]
+	for _, name := range names {
+		col := parquetColumnName(name)
+		if sample.sensors != nil {
+			fields = append(fields, fmt.Sprintf(`{"Tag": "name=%s, type=DOUBLE"}`, col))
+		} else {
+			fields = append(fields, fmt.Sprintf(`{"Tag": "name=%s, type=INT32, convertedtype=INT_16"}`, col))
+		}
+	}
+	return fmt.Sprintf(`{"Tag": "name=sample, repetitiontype=REQUIRED", "Fields": [%s]}`, strings.Join(fields, ", "))
+}
+
+// parquetRow encodes a sample as the JSON row xitongsys/parquet-go's
+// JSON writer expects, matching the columns from parquetSchema and the
+// same scaled/raw values row() writes to CSV.
+func parquetRow(s *Sample) (string, error) {
+	row := map[string]interface{}{
+		"account": string(s.id[:]),
+		"device":  string(s.device[:]),
+		"time":    s.time.UTC().UnixNano() / int64(time.Millisecond),
+		"period":  int32(s.per),
+	}
+	names := s.header()[4:]
+	for k := range s.values {
+		col := parquetColumnName(names[k])
+		v, raw, scaled := s.measurement(k)
+		if scaled {
+			row[col] = v
+		} else {
+			row[col] = int32(raw)
+		}
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func countParquetRows(t *testing.T, path, schema string) int {
+	t.Helper()
+
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatalf("open %s: %s", path, err)
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	if err != nil {
+		t.Fatalf("new reader for %s: %s", path, err)
+	}
+	defer pr.ReadStop()
+	if err := pr.SetSchemaHandlerFromJSON(schema); err != nil {
+		t.Fatalf("set schema for %s: %s", path, err)
+	}
+	return int(pr.GetNumRows())
+}
+
+// TestParquetRollupMultipleFlushesDontOverwrite forces a device to cross
+// parquetMaxBatchSize twice within the same hour (plus a remainder flushed
+// on Close) and confirms each flush lands in its own file instead of a
+// later flush silently overwriting the rows an earlier one wrote to the
+// same (account, device, hour) path.
+func TestParquetRollupMultipleFlushesDontOverwrite(t *testing.T) {
+	dataDir := t.TempDir()
+	r := newParquetRollup(dataDir)
+
+	at := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	total := 2*parquetMaxBatchSize + 5
+	samples := make([]*Sample, total)
+	for i := range samples {
+		samples[i] = makeTestSample("ACCOUNT001", "DEVICE0001", at)
+	}
+	if err := r.Add(samples); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	dir := filepath.Join(dataDir, "ACCOUNT001", "2026/01/02")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d parquet files, want 3 (two size-triggered flushes + one remainder on Close)", len(entries))
+	}
+
+	schema := parquetSchema(samples[0])
+	rows := 0
+	for _, e := range entries {
+		rows += countParquetRows(t, filepath.Join(dir, e.Name()), schema)
+	}
+	if rows != total {
+		t.Fatalf("got %d total rows across files, want %d", rows, total)
+	}
+}
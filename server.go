@@ -3,14 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/csv"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/codegangsta/martini"
@@ -23,12 +23,18 @@ type Sample struct {
 	time   time.Time
 	per    int16
 	values []int16
+
+	// sensors holds per-sensor name/unit/scale metadata for samples
+	// decoded from a v1 (or later) frame. It is nil for v0 samples,
+	// whose values are reported as raw int16s.
+	sensors []SensorMeta
 }
 
 var CONFIG_FN = "./seder.config"
 
 type Config struct {
-	DataDir string `yaml:"data_dir"`
+	DataDir string       `yaml:"data_dir"`
+	Sinks   []SinkConfig `yaml:"sinks,omitempty"`
 }
 
 func main() {
@@ -37,6 +43,25 @@ func main() {
 		log.Fatal(err)
 	}
 
+	sinks, err := newFanOut(config.Sinks, config.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// martini's Run blocks forever, so a deferred Close would never run;
+	// flush in-flight batches (e.g. pending Parquet rollups) ourselves
+	// before the process exits on SIGTERM/SIGINT.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("received %s, flushing sinks before shutdown", s)
+		if err := sinks.Close(); err != nil {
+			log.Printf("error closing sinks: %s", err)
+		}
+		os.Exit(0)
+	}()
+
 	m := martini.Classic()
 
 	m.Get("/", func(req *http.Request) string {
@@ -46,31 +71,59 @@ func main() {
 		return "Hello seder!"
 	})
 
-	m.Post("/v0/data", func(res http.ResponseWriter, req *http.Request) []byte {
+	m.Get("/metrics", martini.Wrap(metricsHandler))
+
+	m.Post("/:version/data", func(params martini.Params, res http.ResponseWriter, req *http.Request) []byte {
+		requestID := nextRequestID()
+		logger := newReqLogger(requestID)
+
+		version := params["version"]
+		decoder, ok := decoders[version]
+		if !ok {
+			writeJSONError(res, http.StatusNotFound, "unknown_version", fmt.Sprintf("unknown data version %q", version), requestID)
+			return nil
+		}
+
 		body, err := ioutil.ReadAll(req.Body)
-		PanicIf(err)
-		log.Printf("received %d bytes\n", len(body))
+		if err != nil {
+			logger.Printf("error reading request body: %s", err)
+			writeJSONError(res, http.StatusInternalServerError, "body_read_error", "could not read request body", requestID)
+			return nil
+		}
+		logger.Printf("received %d bytes (%s)", len(body), version)
+		bytesReceivedTotal.Add(float64(len(body)))
 		if len(body) == 0 {
-			log.Printf("WARNING: body is empty!")
-			for k, v := range req.Header {
-				log.Printf("%20s: %s\n", k, v)
-			}
-			return []byte("!\n")
+			logger.Printf("WARNING: body is empty!")
+			writeJSONError(res, http.StatusBadRequest, "empty_body", ErrEmptyBody.Error(), requestID)
+			return nil
 		}
-		samples := decodeV0(body)
-		// for _, v := range samples {
-
-		// 	// Format values.
-		// 	var buf bytes.Buffer
-		// 	for k, v := range v.values {
-		// 		buf.WriteString(fmt.Sprintf("s%d: %d, ", k, v))
-		// 	}
-		// 	log.Printf("t: %30s, id: %s, device: %s, per: %d, nmeas: %d, %s", v.time.UTC(), string(v.id[:]), string(v.device[:]), v.per, len(v.values), buf.String())
-		// }
-		err = writeToFileV0(samples, config.DataDir)
+
+		samples, err := decoder.Decode(body)
 		if err != nil {
-			log.Printf("error writing samples to file: %s", err)
+			logger.Printf("error decoding %s payload: %s", version, err)
+			recordDecodeError(version, err)
+			status, code := decodeErrorCode(err)
+			writeJSONError(res, status, code, err.Error(), requestID)
+			return nil
+		}
+		recordSamplesReceived(samples)
+		if len(samples) > 0 {
+			logger = logger.withSample(samples[0])
 		}
+
+		if err = sinks.Write(logger, samples); err != nil {
+			if err == ErrQueueFull {
+				logger.Printf("write queue full, applying backpressure")
+				writeJSONError(res, http.StatusServiceUnavailable, "queue_full", err.Error(), requestID)
+				return nil
+			}
+			logger.Printf("error writing samples to sinks: %s", err)
+			writeJSONError(res, http.StatusInternalServerError, "write_error", "failed to persist samples", requestID)
+			return nil
+		}
+		// Samples are enqueued for the writer pool/rollup/kafka sinks to
+		// deliver; the batch is accepted, not necessarily durable yet.
+		res.WriteHeader(http.StatusAccepted)
 		return []byte("!\n")
 	})
 
@@ -106,7 +159,7 @@ func main() {
 // 1        t1 * 1000 + t2 + 1 * SAMP_PERIOD
 // 2        t1 * 1000 + t2 + 2 * SAMP_PERIOD
 // ...
-func decodeV0(body []byte) (samples []*Sample) {
+func decodeV0(body []byte) (samples []*Sample, err error) {
 
 	var id [10]byte
 	var device [10]byte
@@ -115,33 +168,21 @@ func decodeV0(body []byte) (samples []*Sample) {
 	var nmeas byte
 
 	buf := bytes.NewReader(body)
-	err := binary.Read(buf, binary.LittleEndian, &id)
-	PanicIf(err)
-	//log.Printf("id: %s", string(id[:]))
-
-	err = binary.Read(buf, binary.LittleEndian, &device)
-	PanicIf(err)
-	//log.Printf("device: %s", string(device[:]))
-
-	err = binary.Read(buf, binary.LittleEndian, &t1)
-	PanicIf(err)
-	//log.Printf("t1: %d", t1)
-
-	err = binary.Read(buf, binary.LittleEndian, &t2)
-	PanicIf(err)
-	//log.Printf("t2: %d", t2)
-
-	err = binary.Read(buf, binary.LittleEndian, &per)
-	PanicIf(err)
-	//log.Printf("per: %d", per)
-
-	err = binary.Read(buf, binary.LittleEndian, &nsamp)
-	PanicIf(err)
-	//log.Printf("nsamp: %d", nsamp)
+	for _, v := range []interface{}{&id, &device, &t1, &t2, &per, &nsamp, &nmeas} {
+		if err = binary.Read(buf, binary.LittleEndian, v); err != nil {
+			return nil, ErrShortHeader
+		}
+	}
 
-	err = binary.Read(buf, binary.LittleEndian, &nmeas)
-	PanicIf(err)
-	//log.Printf("nmeas: %d", nmeas)
+	if !validID(id) {
+		return nil, ErrBadAccountID
+	}
+	if !validID(device) {
+		return nil, ErrBadDeviceID
+	}
+	if nsamp < 0 || nsamp > maxSamplesPerFrame {
+		return nil, ErrBadSampleCount
+	}
 
 	samples = make([]*Sample, nsamp, nsamp)
 	var i16, i int16
@@ -155,13 +196,50 @@ func decodeV0(body []byte) (samples []*Sample) {
 		}
 		values := make([]int16, nmeas, nmeas)
 		for j = 0; j < nmeas; j++ {
-			err = binary.Read(buf, binary.LittleEndian, &i16)
-			PanicIf(err)
+			if err = binary.Read(buf, binary.LittleEndian, &i16); err != nil {
+				return nil, ErrTruncatedPayload
+			}
 			values[j] = i16
 		}
 		samples[i].values = values
 	}
-	return
+	return samples, nil
+}
+
+// validID reports whether an account or device id is safe to use as a
+// filesystem path component. Every byte must be alphanumeric, '_', or
+// '-'. This is deliberately stricter than "printable ASCII": id and
+// device are joined straight into a file path (see writeToFileV0's
+// successors in writer_pool.go and parquet_writer.go), so letting
+// through bytes like '.' or '/' would let a crafted id (e.g.
+// "../../../x") escape the configured data directory.
+func validID(id [10]byte) bool {
+	for _, c := range id {
+		if !isIDByte(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIDByte(c byte) bool {
+	return (c >= 'A' && c <= 'Z') ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= '0' && c <= '9') ||
+		c == '_' || c == '-'
+}
+
+// measurement returns the k'th analog reading: scaled to a physical
+// value when sensor metadata is present (v1 samples), or the raw int16
+// otherwise (v0 samples). Every sink derives its column values from this
+// so they all agree on what a sample means, instead of the CSV writer
+// and the Parquet writer independently reinterpreting sample.values.
+func (sample Sample) measurement(k int) (value float64, raw int16, scaled bool) {
+	raw = sample.values[k]
+	if sample.sensors != nil {
+		return float64(raw)*float64(sample.sensors[k].Scale) + float64(sample.sensors[k].Offset), raw, true
+	}
+	return float64(raw), raw, false
 }
 
 func (sample Sample) row() []string {
@@ -171,8 +249,13 @@ func (sample Sample) row() []string {
 	st = append(st, string(sample.device[:]))
 	st = append(st, sample.time.UTC().Format(time.RFC3339Nano))
 	st = append(st, strconv.Itoa(int(sample.per)))
-	for _, v := range sample.values {
-		st = append(st, strconv.Itoa(int(v)))
+	for k := range sample.values {
+		v, raw, scaled := sample.measurement(k)
+		if scaled {
+			st = append(st, strconv.FormatFloat(v, 'f', -1, 32))
+			continue
+		}
+		st = append(st, strconv.Itoa(int(raw)))
 	}
 	return st
 }
@@ -183,76 +266,29 @@ func (sample Sample) header() []string {
 	h = append(h, "device")
 	h = append(h, "time")
 	h = append(h, "period")
-	for k, _ := range sample.values {
+	for k := range sample.values {
+		if sample.sensors != nil && sample.sensors[k].Name != "" {
+			h = append(h, sample.sensors[k].Name)
+			continue
+		}
 		h = append(h, fmt.Sprintf("A%d", k))
 	}
 	return h
 }
 
-func writeToFileV0(samples []*Sample, dir string) (err error) {
-
-	if len(samples) == 0 {
-		return nil
-	}
-
-	// Create path.
-	t := samples[0].time.UTC()
-	fn := fmt.Sprintf("%02d-%s.dat", t.Hour(), string(samples[0].device[:]))
-	path := filepath.Join(dir, string(samples[0].id[:]), t.Format("2006/01/02"), fn)
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	if err != nil {
-		log.Printf("can't create path %s", filepath.Dir(path))
-		return
-	}
-
-	var file *os.File
-	file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
-	if err != nil {
-		log.Printf("can't create file %s", path)
-		return
-	}
-	defer file.Close()
-
-	// Write CSV
-	writer := csv.NewWriter(file)
-	fi, err := file.Stat()
-	if err != nil {
-		return
-	}
-	if fi.Size() == 0 {
-		// Write header for new files.
-		err = writer.Write(samples[0].header())
-	}
-	if err != nil {
-		return
-	}
-	for _, v := range samples {
-		err = writer.Write(v.row())
-		if err != nil {
-			return
-		}
-	}
-	writer.Flush()
-	return nil
-}
-
-func PanicIf(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 // Read configuration file.
 func ReadConfig(filename string) (config *Config, err error) {
 
 	var data []byte
 	data, err = ioutil.ReadFile(filename)
 	if err != nil {
+		err = fmt.Errorf("config: can't read %s: %s", filename, err)
 		return
 	}
 	config = &Config{}
 	err = yaml.Unmarshal(data, config)
 	if err != nil {
+		err = fmt.Errorf("config: can't parse %s: %s", filename, err)
 		return
 	}
 	log.Printf("config:\n%s\n", config)
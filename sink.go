@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// SinkConfig describes a single configured delivery destination for decoded
+// samples. Multiple sinks can be configured at once; samples are fanned out
+// to all of them.
+type SinkConfig struct {
+	Type string `yaml:"type"` // "file", "kafka", "stdout"
+
+	// File sink settings.
+	DataDir string `yaml:"data_dir,omitempty"`
+	Writer  string `yaml:"writer,omitempty"` // "csv" (default), "parquet", or "both"
+
+	// Kafka sink settings.
+	Brokers   []string `yaml:"brokers,omitempty"`
+	Topic     string   `yaml:"topic,omitempty"`
+	Partition string   `yaml:"partition,omitempty"` // "account", "device", "account_device"
+	Acks      string   `yaml:"acks,omitempty"`      // "none", "local", "all"
+}
+
+// Sink receives a batch of decoded samples for delivery to a destination.
+// Implementations must be safe to call from the request goroutine. logger
+// is the calling request's logger, already tagged with account/device/
+// request id, so a sink can report delivery problems with full context.
+type Sink interface {
+	Write(logger *reqLogger, samples []*Sample) error
+	Close() error
+}
+
+// NewSink builds a Sink from its configuration. The file sink manages
+// its own async delivery (writerPool/parquetRollup); stdout and kafka are
+// wrapped in asyncSink so they don't block the request goroutine on I/O
+// either (a Kafka broker hiccup would otherwise stall every POST).
+func NewSink(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case "", "file":
+		return newFileSink(cfg), nil
+	case "stdout":
+		return newAsyncSink(&stdoutSink{}), nil
+	case "kafka":
+		inner, err := newKafkaSink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newAsyncSink(inner), nil
+	}
+	return nil, fmt.Errorf("sink: unknown type %q", cfg.Type)
+}
+
+// fanOut dispatches a batch of samples to every configured sink and
+// collects any errors.
+type fanOut struct {
+	sinks []Sink
+}
+
+// newFanOut builds a fanOut from the configured sinks. When no sinks are
+// configured it falls back to a single file sink rooted at dataDir, so
+// existing configs without a `sinks` section keep working unchanged.
+func newFanOut(sinkConfigs []SinkConfig, dataDir string) (*fanOut, error) {
+	if len(sinkConfigs) == 0 {
+		sinkConfigs = []SinkConfig{{Type: "file", DataDir: dataDir}}
+	}
+	f := &fanOut{}
+	for _, cfg := range sinkConfigs {
+		s, err := NewSink(cfg)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.sinks = append(f.sinks, s)
+	}
+	return f, nil
+}
+
+func (f *fanOut) Write(logger *reqLogger, samples []*Sample) error {
+	var errs []error
+	for _, s := range f.sinks {
+		if err := s.Write(logger, samples); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("fanout", errs)
+}
+
+func (f *fanOut) Close() error {
+	var errs []error
+	for _, s := range f.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("fanout", errs)
+}
+
+// joinErrors combines zero or more errors from independent sinks into a
+// single error. A single error is returned unwrapped so sentinel values
+// (e.g. ErrQueueFull) survive through a sink that only has one backend
+// and the caller can still compare against them.
+func joinErrors(context string, errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+		return fmt.Errorf("%s: %s", context, strings.Join(msgs, "; "))
+	}
+}
+
+// fileSink writes samples to per-account/device/hour files on disk. Row
+// oriented CSV writes are enqueued onto a writerPool so a burst of POSTs
+// doesn't open/append/close on the request goroutine; Parquet rollups (if
+// enabled) are batched separately by parquetRollup.
+type fileSink struct {
+	dataDir string
+	writer  string // "csv", "parquet", or "both"
+	pool    *writerPool
+	rollup  *parquetRollup
+}
+
+func newFileSink(cfg SinkConfig) *fileSink {
+	w := cfg.Writer
+	if w == "" {
+		w = "csv"
+	}
+	s := &fileSink{dataDir: cfg.DataDir, writer: w}
+	if w == "csv" || w == "both" {
+		s.pool = newWriterPool(cfg.DataDir)
+	}
+	if w == "parquet" || w == "both" {
+		s.rollup = newParquetRollup(cfg.DataDir)
+	}
+	return s
+}
+
+func (s *fileSink) Write(logger *reqLogger, samples []*Sample) error {
+	var errs []error
+	if s.pool != nil {
+		if err := s.pool.Enqueue(logger, samples); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.rollup != nil {
+		if err := s.rollup.Add(samples); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("file sink", errs)
+}
+
+func (s *fileSink) Close() error {
+	var errs []error
+	if s.pool != nil {
+		if err := s.pool.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.rollup != nil {
+		if err := s.rollup.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors("file sink", errs)
+}
+
+// stdoutSink logs each sample row, mostly useful for local debugging.
+type stdoutSink struct{}
+
+func (s *stdoutSink) Write(logger *reqLogger, samples []*Sample) error {
+	for _, v := range samples {
+		logger.Printf("sample: %s", strings.Join(v.row(), ","))
+	}
+	return nil
+}
+
+func (s *stdoutSink) Close() error { return nil }
+
+// kafkaSink publishes each sample as a CSV-encoded message to a Kafka
+// topic, keyed on account/device so a downstream consumer can repartition
+// per device.
+type kafkaSink struct {
+	topic     string
+	partition string
+	producer  sarama.SyncProducer
+}
+
+func newKafkaSink(cfg SinkConfig) (*kafkaSink, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("sink: kafka sink requires at least one broker")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("sink: kafka sink requires a topic")
+	}
+
+	sconfig := sarama.NewConfig()
+	sconfig.Producer.Return.Successes = true
+	switch cfg.Acks {
+	case "none":
+		sconfig.Producer.RequiredAcks = sarama.NoResponse
+	case "all":
+		sconfig.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		sconfig.Producer.RequiredAcks = sarama.WaitForLocal
+	}
+
+	producer, err := sarama.NewSyncProducer(cfg.Brokers, sconfig)
+	if err != nil {
+		return nil, fmt.Errorf("sink: can't connect to kafka brokers %v: %s", cfg.Brokers, err)
+	}
+
+	partition := cfg.Partition
+	if partition == "" {
+		partition = "account_device"
+	}
+
+	return &kafkaSink{topic: cfg.Topic, partition: partition, producer: producer}, nil
+}
+
+// partitionKey derives the kafka message key from a sample according to
+// the configured partitioning strategy.
+func (s *kafkaSink) partitionKey(sample *Sample) string {
+	switch s.partition {
+	case "account":
+		return string(sample.id[:])
+	case "device":
+		return string(sample.device[:])
+	default:
+		return string(sample.id[:]) + ":" + string(sample.device[:])
+	}
+}
+
+func (s *kafkaSink) Write(logger *reqLogger, samples []*Sample) error {
+	for _, v := range samples {
+		msg := &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(s.partitionKey(v)),
+			Value: sarama.StringEncoder(strings.Join(v.row(), ",")),
+		}
+		if _, _, err := s.producer.SendMessage(msg); err != nil {
+			return fmt.Errorf("sink: kafka publish failed: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *kafkaSink) Close() error {
+	return s.producer.Close()
+}
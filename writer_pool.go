@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writerPoolWorkers is the number of worker goroutines a writerPool
+// spreads (account, device, hour) shards across.
+const writerPoolWorkers = 8
+
+// writerPoolQueueSize bounds each worker's backlog. Once full, Enqueue
+// returns ErrQueueFull so the caller can push back with a 503 instead of
+// blocking the request goroutine.
+const writerPoolQueueSize = 256
+
+// writerIdleTimeout closes a cached writer's underlying file once it has
+// gone unused for this long, so a long-running process doesn't keep file
+// descriptors open for devices that stopped reporting.
+const writerIdleTimeout = 5 * time.Minute
+
+// writerFlushInterval is how often a worker flushes and fsyncs its open
+// writers even without new traffic.
+const writerFlushInterval = 10 * time.Second
+
+// writeJob is one batch enqueued onto a writerPool worker.
+type writeJob struct {
+	logger  *reqLogger
+	samples []*Sample
+}
+
+// writerPool replaces the per-request open/append/close writeToFileV0
+// path with N worker goroutines, each owning a cache of open *csv.Writers
+// keyed by file path. Batches are sharded onto a worker by hashing their
+// (account, device, hour) key, so every write to a given file happens on
+// the same goroutine and never needs locking.
+type writerPool struct {
+	dataDir string
+	queues  []chan writeJob
+	wg      sync.WaitGroup
+
+	// closedMu guards closed and serializes Enqueue against Close: Close
+	// takes the write lock (so it can't proceed while any Enqueue is
+	// mid-send) and Enqueue takes the read lock and checks closed before
+	// sending, so a shutdown can never race a send on a closed channel.
+	closedMu sync.RWMutex
+	closed   bool
+}
+
+func newWriterPool(dataDir string) *writerPool {
+	p := &writerPool{
+		dataDir: dataDir,
+		queues:  make([]chan writeJob, writerPoolWorkers),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan writeJob, writerPoolQueueSize)
+		p.wg.Add(1)
+		go p.runWorker(p.queues[i])
+	}
+	return p
+}
+
+// shardFor picks the worker queue a batch's (account, device, hour) key
+// hashes to.
+func (p *writerPool) shardFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()) % len(p.queues)
+}
+
+// Enqueue hands a batch to its worker's queue and returns immediately.
+// If that queue is full it returns ErrQueueFull rather than blocking, so
+// the HTTP handler can surface backpressure as a 503.
+func (p *writerPool) Enqueue(logger *reqLogger, samples []*Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	p.closedMu.RLock()
+	defer p.closedMu.RUnlock()
+	if p.closed {
+		return ErrQueueFull
+	}
+
+	key := parquetBatchKey(string(samples[0].id[:]), string(samples[0].device[:]), samples[0].time.UTC().Truncate(time.Hour))
+	q := p.queues[p.shardFor(key)]
+	select {
+	case q <- writeJob{logger: logger, samples: samples}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (p *writerPool) runWorker(queue chan writeJob) {
+	defer p.wg.Done()
+	cache := newWriterCache()
+	flush := time.NewTicker(writerFlushInterval)
+	defer flush.Stop()
+	for {
+		select {
+		case job, ok := <-queue:
+			if !ok {
+				cache.closeAll()
+				return
+			}
+			cache.write(job.logger, job.samples, p.dataDir)
+		case <-flush.C:
+			cache.flushIdle()
+		}
+	}
+}
+
+// Close stops accepting new work, drains each worker's queue, and closes
+// every cached writer (flushing and fsyncing first) so a graceful
+// shutdown doesn't lose buffered rows.
+func (p *writerPool) Close() error {
+	p.closedMu.Lock()
+	if p.closed {
+		p.closedMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.closedMu.Unlock()
+
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// cachedWriter is one open file/writer pair owned by a single worker.
+type cachedWriter struct {
+	file     *os.File
+	writer   *csv.Writer
+	lastUsed time.Time
+}
+
+// writerCache holds the cachedWriters for one worker, keyed by file
+// path. An entry is evicted only by flushIdle once it has gone unused for
+// writerIdleTimeout; the number of open writers is not bounded and there
+// is no least-recently-used eviction. It is only ever touched from that
+// worker's own goroutine, so it needs no locking.
+type writerCache struct {
+	entries map[string]*cachedWriter
+}
+
+func newWriterCache() *writerCache {
+	return &writerCache{entries: make(map[string]*cachedWriter)}
+}
+
+func (c *writerCache) write(logger *reqLogger, samples []*Sample, dataDir string) {
+	if len(samples) == 0 {
+		return
+	}
+
+	t := samples[0].time.UTC()
+	fn := fmt.Sprintf("%02d-%s.dat", t.Hour(), string(samples[0].device[:]))
+	path := filepath.Join(dataDir, string(samples[0].id[:]), t.Format("2006/01/02"), fn)
+
+	cw, err := c.open(path)
+	if err != nil {
+		logger.Printf("can't open %s: %s", path, err)
+		fileOpenErrorsTotal.Inc()
+		return
+	}
+	cw.lastUsed = time.Now()
+
+	timer := prometheus.NewTimer(writeLatencySeconds)
+	defer timer.ObserveDuration()
+
+	if fi, err := cw.file.Stat(); err == nil && fi.Size() == 0 {
+		if err := cw.writer.Write(samples[0].header()); err != nil {
+			logger.Printf("can't write header to %s: %s", path, err)
+			return
+		}
+	}
+	for _, v := range samples {
+		if err := cw.writer.Write(v.row()); err != nil {
+			logger.Printf("can't write row to %s: %s", path, err)
+			return
+		}
+	}
+	cw.writer.Flush()
+}
+
+func (c *writerCache) open(path string) (*cachedWriter, error) {
+	if cw, ok := c.entries[path]; ok {
+		return cw, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cw := &cachedWriter{file: file, writer: csv.NewWriter(file), lastUsed: time.Now()}
+	c.entries[path] = cw
+	return cw, nil
+}
+
+// flushIdle flushes and fsyncs every open writer, closing and evicting
+// any that have gone unused for writerIdleTimeout.
+func (c *writerCache) flushIdle() {
+	now := time.Now()
+	for path, cw := range c.entries {
+		cw.writer.Flush()
+		if err := cw.file.Sync(); err != nil {
+			log.Printf("writer cache: fsync failed for %s: %s", path, err)
+		}
+		if now.Sub(cw.lastUsed) >= writerIdleTimeout {
+			cw.file.Close()
+			delete(c.entries, path)
+		}
+	}
+}
+
+func (c *writerCache) closeAll() {
+	for path, cw := range c.entries {
+		cw.writer.Flush()
+		cw.file.Sync()
+		cw.file.Close()
+		delete(c.entries, path)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeTestSample(account, device string, at time.Time) *Sample {
+	s := &Sample{time: at, per: 1000, values: []int16{1}}
+	copy(s.id[:], account)
+	copy(s.device[:], device)
+	return s
+}
+
+// TestWriterPoolEnqueueCloseRace exercises concurrent Enqueue calls racing
+// a Close, which used to panic with "send on closed channel" before
+// writerPool gained its closedMu guard: Close would close a worker's
+// queue while an Enqueue on another goroutine was still sending to it.
+func TestWriterPoolEnqueueCloseRace(t *testing.T) {
+	p := newWriterPool(t.TempDir())
+	logger := newReqLogger("req-race")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sample := makeTestSample("ACCOUNT001", "DEVICE0001", time.Unix(int64(i), 0))
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Enqueue panicked: %v", r)
+				}
+			}()
+			p.Enqueue(logger, []*Sample{sample})
+		}(i)
+	}
+
+	closeErr := p.Close()
+	wg.Wait()
+	if closeErr != nil {
+		t.Fatalf("Close: %s", closeErr)
+	}
+}
+
+// TestWriterPoolWritesSamples confirms a batch handed to Enqueue actually
+// lands on disk once the pool is closed and has drained.
+func TestWriterPoolWritesSamples(t *testing.T) {
+	dataDir := t.TempDir()
+	p := newWriterPool(dataDir)
+	logger := newReqLogger("req-1")
+
+	at := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	sample := makeTestSample("ACCOUNT001", "DEVICE0001", at)
+
+	if err := p.Enqueue(logger, []*Sample{sample}); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	path := filepath.Join(dataDir, "ACCOUNT001", "2026/01/02", "03-DEVICE0001.dat")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected data file at %s: %s", path, err)
+	}
+}
+
+// TestWriterPoolEnqueueAfterCloseReturnsQueueFull confirms the closed
+// check, not a channel send, is what rejects work submitted after Close.
+func TestWriterPoolEnqueueAfterCloseReturnsQueueFull(t *testing.T) {
+	p := newWriterPool(t.TempDir())
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	sample := makeTestSample("ACCOUNT001", "DEVICE0001", time.Now().UTC())
+	if err := p.Enqueue(newReqLogger("req-after-close"), []*Sample{sample}); err != ErrQueueFull {
+		t.Fatalf("Enqueue after Close: got err %v, want ErrQueueFull", err)
+	}
+}